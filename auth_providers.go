@@ -0,0 +1,196 @@
+// Copyright 2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter_shared
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/log"
+)
+
+// chainAuthProviders is an AuthProvider that succeeds if any of its providers
+// accepts the request.
+type chainAuthProviders struct {
+	providers []AuthProvider
+}
+
+// ChainAuthProviders combines providers into a single AuthProvider that
+// allows a request if any of them does, e.g. "allow requests from 10.0.0.0/8
+// OR a valid bearer token":
+//
+//	ipAuth, _ := NewIPAllowlistAuth([]string{"10.0.0.0/8"})
+//	tokenAuth, _ := NewBearerTokenAuth("/etc/exporter/tokens")
+//	ChainAuthProviders(ipAuth, tokenAuth)
+func ChainAuthProviders(providers ...AuthProvider) AuthProvider {
+	return &chainAuthProviders{providers: providers}
+}
+
+// IsAllowed implements AuthProvider.
+func (c *chainAuthProviders) IsAllowed(r *http.Request) bool {
+	for _, p := range c.providers {
+		if p.IsAllowed(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Challenge implements AuthProvider. It lets every provider contribute its
+// own challenge headers, so a client sees all the schemes it could use.
+func (c *chainAuthProviders) Challenge(w http.ResponseWriter) {
+	for _, p := range c.providers {
+		p.Challenge(w)
+	}
+}
+
+// bearerTokenAuth is an AuthProvider backed by a file of bearer tokens, one
+// per line, compared in constant time.
+type bearerTokenAuth struct {
+	tokens map[string]bool
+}
+
+// NewBearerTokenAuth builds an AuthProvider that allows requests carrying an
+// "Authorization: Bearer <token>" header matching one of the tokens loaded
+// from path, one per line, ignoring blank lines and lines starting with '#'.
+// Tokens are compared in constant time.
+func NewBearerTokenAuth(path string) (AuthProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read bearer token file %q: %s", path, err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	tokens := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens[line] = true
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &bearerTokenAuth{tokens: tokens}, nil
+}
+
+// IsAllowed implements AuthProvider.
+func (a *bearerTokenAuth) IsAllowed(r *http.Request) bool {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+	token := header[len(prefix):]
+
+	for known := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Challenge implements AuthProvider.
+func (a *bearerTokenAuth) Challenge(w http.ResponseWriter) {
+	w.Header().Add("WWW-Authenticate", `Bearer realm="metrics"`)
+}
+
+// ipAllowlistAuth is an AuthProvider that allows requests whose remote
+// address falls within one of a set of CIDR ranges.
+type ipAllowlistAuth struct {
+	nets []*net.IPNet
+}
+
+// NewIPAllowlistAuth builds an AuthProvider that allows requests whose
+// remote address falls within one of cidrs (e.g. "10.0.0.0/8", "::1/128").
+func NewIPAllowlistAuth(cidrs []string) (AuthProvider, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %s", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return &ipAllowlistAuth{nets: nets}, nil
+}
+
+// IsAllowed implements AuthProvider.
+func (a *ipAllowlistAuth) IsAllowed(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range a.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Challenge implements AuthProvider. There is no header that makes an
+// IP-allowlist request succeed, so there is nothing to add to the response.
+func (a *ipAllowlistAuth) Challenge(http.ResponseWriter) {}
+
+// HandlerOptions configures Handler and RunServer.
+type HandlerOptions struct {
+	// ErrorHandling controls how the handler behaves when errors occur while
+	// gathering metrics.
+	ErrorHandling promhttp.HandlerErrorHandling
+
+	// Auth, if non-nil, is consulted before serving metrics. Use
+	// ChainAuthProviders to combine several providers, e.g. a static user plus
+	// an IP allowlist.
+	Auth AuthProvider
+}
+
+// Handler returns an http.Handler serving gatherer's metrics, wrapped with
+// opts.Auth if set. It supersedes the package's hard-coded single-credential
+// path for callers that want to compose their own AuthProviders.
+func Handler(gatherer prometheus.Gatherer, opts HandlerOptions) http.Handler {
+	h := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		ErrorLog:      log.NewErrorLogger(),
+		ErrorHandling: opts.ErrorHandling,
+	})
+
+	if opts.Auth == nil {
+		return h
+	}
+	return &basicAuthHandler{provider: opts.Auth, handler: h.ServeHTTP}
+}
+
+// check interfaces
+var (
+	_ AuthProvider = (*chainAuthProviders)(nil)
+	_ AuthProvider = (*bearerTokenAuth)(nil)
+	_ AuthProvider = (*ipAllowlistAuth)(nil)
+)
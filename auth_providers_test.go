@@ -0,0 +1,77 @@
+// Copyright 2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter_shared
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// TestChainAuthProvidersIPOrBearerToken exercises the "allow requests from
+// 10.0.0.0/8 OR valid bearer token" example from ChainAuthProviders' doc
+// comment, using the exported constructors a downstream exporter would call.
+func TestChainAuthProvidersIPOrBearerToken(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "tokens")
+	if err := ioutil.WriteFile(tokenFile, []byte("# comment\nsecret-token\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	ipAuth, err := NewIPAllowlistAuth([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("NewIPAllowlistAuth: %s", err)
+	}
+	tokenAuth, err := NewBearerTokenAuth(tokenFile)
+	if err != nil {
+		t.Fatalf("NewBearerTokenAuth: %s", err)
+	}
+
+	chain := ChainAuthProviders(ipAuth, tokenAuth)
+
+	cases := []struct {
+		name      string
+		remoteIP  string
+		authToken string
+		want      bool
+	}{
+		{"allowed IP, no token", "10.1.2.3:4567", "", true},
+		{"disallowed IP, valid token", "192.168.1.1:4567", "secret-token", true},
+		{"disallowed IP, invalid token", "192.168.1.1:4567", "wrong-token", false},
+		{"disallowed IP, no token", "192.168.1.1:4567", "", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			req.RemoteAddr = c.remoteIP
+			if c.authToken != "" {
+				req.Header.Set("Authorization", "Bearer "+c.authToken)
+			}
+
+			if got := chain.IsAllowed(req); got != c.want {
+				t.Errorf("chain.IsAllowed() = %v, want %v", got, c.want)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	chain.Challenge(rec)
+	if got := rec.Header().Values("WWW-Authenticate"); len(got) != 1 || got[0] != `Bearer realm="metrics"` {
+		t.Errorf("Challenge() set WWW-Authenticate = %v, want exactly one Bearer challenge", got)
+	}
+}
@@ -17,7 +17,6 @@ package exporter_shared
 import (
 	"crypto/subtle"
 	"flag"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -41,12 +40,29 @@ var (
 		"Path to YAML file with server_user, server_password keys for HTTP Basic authentication "+
 			"(overrides HTTP_AUTH environment variable).",
 	).Default("").String()
+
+	htpasswdFileF = kingpin.Flag(
+		"web.htpasswd-file",
+		"Path to an Apache-style htpasswd file for HTTP Basic authentication "+
+			"(takes precedence over -web.auth-file and HTTP_AUTH). "+
+			"Reloaded on SIGHUP or when the file's mtime changes.",
+	).Default("").String()
+
+	authSchemeF = kingpin.Flag(
+		"web.auth-scheme",
+		"Authentication scheme(s) to offer: basic, digest, or basic+digest.",
+	).Default("basic").Enum("basic", "digest", "basic+digest")
 )
 
-// basicAuth combines username and password.
+// basicAuth combines username and password, plus the extra settings needed
+// for HTTP Digest authentication when -web.auth-scheme enables it.
 type basicAuth struct {
 	Username string `yaml:"server_user,omitempty"`
 	Password string `yaml:"server_password,omitempty"`
+
+	Realm         string `yaml:"realm,omitempty"`
+	NonceLifetime string `yaml:"nonce_lifetime,omitempty"`
+	HtdigestFile  string `yaml:"htdigest_file,omitempty"`
 }
 
 // readBasicAuth returns basicAuth from -web.auth-file file, or HTTP_AUTH environment variable, or empty one.
@@ -63,7 +79,6 @@ func readBasicAuth() *basicAuth {
 			log.Fatalf("cannot parse auth file %q: %s", *authFileF, err)
 		}
 	case *authFileFKingpin != "":
-		fmt.Println("!!!!!!!!!!!!")
 		bytes, err := ioutil.ReadFile(*authFileFKingpin)
 		if err != nil {
 			log.Fatalf("cannot read auth file %q: %s", *authFileFKingpin, err)
@@ -85,19 +100,48 @@ func readBasicAuth() *basicAuth {
 	return &auth
 }
 
-// basicAuthHandler checks username and password before invoking provided handler.
-type basicAuthHandler struct {
+// AuthProvider decides whether a request carries valid credentials and how to
+// challenge it when it does not. It allows basicAuthHandler to be backed by
+// different credential sources (a single YAML/env user, an htpasswd file, etc).
+type AuthProvider interface {
+	// IsAllowed reports whether r carries valid credentials.
+	IsAllowed(r *http.Request) bool
+
+	// Challenge writes the headers (e.g. WWW-Authenticate) that tell the client
+	// how to authenticate. It is called before the 401 response is written.
+	Challenge(w http.ResponseWriter)
+}
+
+// singleCredentialAuth is an AuthProvider backed by a single username/password
+// pair, as read by readBasicAuth.
+type singleCredentialAuth struct {
 	basicAuth
-	handler http.HandlerFunc
+}
+
+// IsAllowed implements AuthProvider.
+func (a *singleCredentialAuth) IsAllowed(r *http.Request) bool {
+	username, password, _ := r.BasicAuth()
+	usernameOk := subtle.ConstantTimeCompare([]byte(a.Username), []byte(username)) == 1
+	passwordOk := subtle.ConstantTimeCompare([]byte(a.Password), []byte(password)) == 1
+	return usernameOk && passwordOk
+}
+
+// Challenge implements AuthProvider.
+func (a *singleCredentialAuth) Challenge(w http.ResponseWriter) {
+	w.Header().Add("WWW-Authenticate", `Basic realm="metrics"`)
+}
+
+// basicAuthHandler checks credentials via an AuthProvider before invoking the
+// provided handler.
+type basicAuthHandler struct {
+	provider AuthProvider
+	handler  http.HandlerFunc
 }
 
 // ServeHTTP implements http.Handler.
 func (h *basicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	username, password, _ := r.BasicAuth()
-	usernameOk := subtle.ConstantTimeCompare([]byte(h.Username), []byte(username)) == 1
-	passwordOk := subtle.ConstantTimeCompare([]byte(h.Password), []byte(password)) == 1
-	if !usernameOk || !passwordOk {
-		w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+	if !h.provider.IsAllowed(r) {
+		h.provider.Challenge(w)
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
@@ -112,16 +156,83 @@ func handler(errorHandling promhttp.HandlerErrorHandling) http.Handler {
 		ErrorHandling: errorHandling,
 	})
 
+	switch *authSchemeF {
+	case "digest":
+		digest, err := newDigestAuth(readBasicAuth())
+		if err != nil {
+			log.Fatalf("cannot enable Digest authentication: %s", err)
+		}
+		handler = &digestAuthHandler{auth: digest, handler: handler.ServeHTTP}
+		log.Infoln("HTTP Digest authentication is enabled.")
+	case "basic+digest":
+		digest, err := newDigestAuth(readBasicAuth())
+		if err != nil {
+			log.Fatalf("cannot enable Digest authentication: %s", err)
+		}
+		provider := basicProviderFor()
+		if provider == nil {
+			provider = denyAllAuth{}
+		}
+		handler = &multiSchemeAuthHandler{
+			digest:        digest,
+			basicProvider: provider,
+			handler:       handler.ServeHTTP,
+		}
+		log.Infoln("HTTP Basic and Digest authentication are enabled.")
+	default:
+		handler = basicAuthHandlerFor(handler.ServeHTTP)
+	}
+
+	return handler
+}
+
+// basicProviderFor returns the configured Basic AuthProvider (htpasswd file
+// takes precedence over the single YAML/env user), or nil if neither is
+// configured.
+func basicProviderFor() AuthProvider {
+	if *htpasswdFileF != "" {
+		provider, err := newHtpasswdAuth(*htpasswdFileF)
+		if err != nil {
+			log.Fatalf("cannot load htpasswd file %q: %s", *htpasswdFileF, err)
+		}
+		log.Infoln("HTTP Basic authentication (htpasswd file) is enabled.")
+		return provider
+	}
+
 	auth := readBasicAuth()
 	if auth.Username != "" && auth.Password != "" {
-		handler = &basicAuthHandler{basicAuth: *auth, handler: handler.ServeHTTP}
 		log.Infoln("HTTP Basic authentication is enabled.")
+		return &singleCredentialAuth{basicAuth: *auth}
 	}
 
-	return handler
+	return nil
+}
+
+// basicAuthHandlerFor wraps next with whichever Basic AuthProvider is
+// configured, or returns next unchanged if neither is configured.
+func basicAuthHandlerFor(next http.HandlerFunc) http.Handler {
+	provider := basicProviderFor()
+	if provider == nil {
+		return http.HandlerFunc(next)
+	}
+	return &basicAuthHandler{provider: provider, handler: next}
 }
 
+// denyAllAuth is an AuthProvider that never allows a request and never adds
+// challenge headers. It stands in for the Basic side of basic+digest when no
+// Basic credentials (auth-file, HTTP_AUTH, or htpasswd file) are configured.
+type denyAllAuth struct{}
+
+// IsAllowed implements AuthProvider.
+func (denyAllAuth) IsAllowed(*http.Request) bool { return false }
+
+// Challenge implements AuthProvider.
+func (denyAllAuth) Challenge(http.ResponseWriter) {}
+
 // check interfaces
 var (
 	_ http.Handler = (*basicAuthHandler)(nil)
+	_ AuthProvider = (*singleCredentialAuth)(nil)
+	_ AuthProvider = (*htpasswdAuth)(nil)
+	_ AuthProvider = denyAllAuth{}
 )
@@ -0,0 +1,366 @@
+// Copyright 2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter_shared
+
+import (
+	"bufio"
+	"crypto/md5" //nolint:gosec
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// defaultNonceLifetime is used when basicAuth.NonceLifetime is empty; an
+// invalid value makes newDigestAuth return an error.
+const defaultNonceLifetime = 5 * time.Minute
+
+// nonceState tracks the server nonces handed out to clients, so replayed or
+// expired nc values can be rejected.
+type nonceState struct {
+	created  time.Time
+	clientIP string
+	seenNC   map[string]bool
+}
+
+// clientIP returns r's address without its port, for binding nonces to the
+// client that requested them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// digestAuth implements RFC 2617 HTTP Digest authentication.
+type digestAuth struct {
+	realm         string
+	nonceLifetime time.Duration
+	opaque        string
+
+	// lookupHA1 returns HA1 = MD5(username:realm:password) for username, or
+	// false if username is unknown.
+	lookupHA1 func(username string) (string, bool)
+
+	mu     sync.Mutex
+	nonces map[string]*nonceState
+}
+
+// newDigestAuth builds a digestAuth from auth, reading credentials from
+// auth.HtdigestFile if set, or falling back to auth.Username/auth.Password.
+func newDigestAuth(auth *basicAuth) (*digestAuth, error) {
+	realm := auth.Realm
+	if realm == "" {
+		realm = "metrics"
+	}
+
+	lifetime := defaultNonceLifetime
+	if auth.NonceLifetime != "" {
+		d, err := time.ParseDuration(auth.NonceLifetime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nonce_lifetime %q: %s", auth.NonceLifetime, err)
+		}
+		lifetime = d
+	}
+
+	lookup, err := digestLookupFunc(auth, realm)
+	if err != nil {
+		return nil, err
+	}
+
+	opaque, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	return &digestAuth{
+		realm:         realm,
+		nonceLifetime: lifetime,
+		opaque:        opaque,
+		lookupHA1:     lookup,
+		nonces:        make(map[string]*nonceState),
+	}, nil
+}
+
+// digestLookupFunc returns the HA1 lookup function for auth: from an htdigest
+// file when configured, otherwise computed from the single configured user.
+func digestLookupFunc(auth *basicAuth, realm string) (func(string) (string, bool), error) {
+	if auth.HtdigestFile == "" {
+		if auth.Username == "" || auth.Password == "" {
+			return nil, fmt.Errorf("digest auth requires either htdigest_file or server_user/server_password")
+		}
+		ha1 := md5Hex(auth.Username + ":" + realm + ":" + auth.Password)
+		return func(username string) (string, bool) {
+			if subtle.ConstantTimeCompare([]byte(username), []byte(auth.Username)) == 1 {
+				return ha1, true
+			}
+			return "", false
+		}, nil
+	}
+
+	users, err := parseHtdigestFile(auth.HtdigestFile, realm)
+	if err != nil {
+		return nil, err
+	}
+	return func(username string) (string, bool) {
+		ha1, ok := users[username]
+		return ha1, ok
+	}, nil
+}
+
+// parseHtdigestFile reads a standard "user:realm:HA1" htdigest file, keeping
+// only entries for realm.
+func parseHtdigestFile(path, realm string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			log.Errorf("htdigest file %q: skipping malformed line %q", path, line)
+			continue
+		}
+		if parts[1] != realm {
+			continue
+		}
+		users[parts[0]] = parts[2]
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// digestAuthHandler checks credentials via RFC 2617 Digest authentication
+// before invoking the provided handler. It is analogous to basicAuthHandler,
+// but needs its own ServeHTTP since Digest challenges depend on the outcome
+// of the previous verification (stale nonce vs. invalid credentials).
+type digestAuthHandler struct {
+	auth    *digestAuth
+	handler http.HandlerFunc
+}
+
+// ServeHTTP implements http.Handler.
+func (h *digestAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	allowed, stale := h.auth.verify(r)
+	if !allowed {
+		h.auth.challenge(w, r, stale)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	h.handler(w, r)
+}
+
+// verify checks the Authorization header of r. It reports whether the request
+// is allowed, and if not, whether the client should retry immediately with a
+// fresh nonce (stale=true) rather than re-prompting for credentials.
+func (a *digestAuth) verify(r *http.Request) (allowed, stale bool) {
+	params, ok := parseDigestAuthorization(r.Header.Get("Authorization"))
+	if !ok {
+		return false, false
+	}
+
+	if params["realm"] != a.realm || params["opaque"] != a.opaque {
+		return false, false
+	}
+
+	ha1, ok := a.lookupHA1(params["username"])
+	if !ok {
+		return false, false
+	}
+
+	nonce, nc := params["nonce"], params["nc"]
+
+	a.mu.Lock()
+	state, known := a.nonces[nonce]
+	if !known {
+		a.mu.Unlock()
+		// The nonce may simply have been swept out as expired rather than
+		// never issued; either way the client should retry silently with a
+		// fresh one instead of re-prompting for credentials.
+		return false, true
+	}
+	expired := time.Since(state.created) > a.nonceLifetime
+	replayed := state.seenNC[nc]
+	ipMismatch := state.clientIP != "" && state.clientIP != clientIP(r)
+	a.mu.Unlock()
+
+	if ipMismatch {
+		return false, false
+	}
+	if replayed {
+		return false, true
+	}
+
+	ha2 := md5Hex(r.Method + ":" + params["uri"])
+	qop := params["qop"]
+	var expected string
+	if qop != "" {
+		expected = md5Hex(strings.Join([]string{ha1, nonce, nc, params["cnonce"], qop, ha2}, ":"))
+	} else {
+		expected = md5Hex(strings.Join([]string{ha1, nonce, ha2}, ":"))
+	}
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(params["response"])) != 1 {
+		return false, false
+	}
+
+	// Only a request whose response hash actually checked out gets to consume
+	// this nc; re-check for a concurrent replay before marking it seen.
+	a.mu.Lock()
+	if state.seenNC[nc] {
+		a.mu.Unlock()
+		return false, true
+	}
+	state.seenNC[nc] = true
+	a.mu.Unlock()
+
+	if expired {
+		return false, true
+	}
+	return true, false
+}
+
+// challenge writes a WWW-Authenticate: Digest header with a freshly minted
+// nonce. stale is set when the client's previous nonce expired or was reused,
+// so it can retry immediately without re-asking the user for credentials.
+func (a *digestAuth) challenge(w http.ResponseWriter, r *http.Request, stale bool) {
+	nonce, err := randomHex(16)
+	if err != nil {
+		log.Errorf("cannot generate digest nonce: %s", err)
+		return
+	}
+
+	a.mu.Lock()
+	a.sweepExpiredNoncesLocked()
+	a.nonces[nonce] = &nonceState{created: time.Now(), clientIP: clientIP(r), seenNC: make(map[string]bool)}
+	a.mu.Unlock()
+
+	header := fmt.Sprintf(
+		`Digest realm=%q, qop="auth", nonce=%q, opaque=%q`,
+		a.realm, nonce, a.opaque,
+	)
+	if stale {
+		header += `, stale=true`
+	}
+	w.Header().Add("WWW-Authenticate", header)
+}
+
+// sweepExpiredNoncesLocked removes nonces older than a.nonceLifetime, so that
+// repeated unauthenticated requests (e.g. a scraper with no credentials)
+// cannot grow a.nonces without bound. Callers must hold a.mu.
+func (a *digestAuth) sweepExpiredNoncesLocked() {
+	now := time.Now()
+	for nonce, state := range a.nonces {
+		if now.Sub(state.created) > a.nonceLifetime {
+			delete(a.nonces, nonce)
+		}
+	}
+}
+
+// parseDigestAuthorization parses the quoted key=value pairs of a
+// "Digest ..." Authorization header value.
+func parseDigestAuthorization(header string) (map[string]string, bool) {
+	const prefix = "Digest "
+	if !strings.HasPrefix(header, prefix) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for _, field := range strings.Split(header[len(prefix):], ",") {
+		field = strings.TrimSpace(field)
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+
+	for _, required := range []string{"username", "realm", "nonce", "uri", "response"} {
+		if params[required] == "" {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// multiSchemeAuthHandler accepts either Basic or Digest credentials, for
+// -web.auth-scheme=basic+digest. Its 401 response always advertises Digest,
+// and Basic too whenever Basic credentials are configured, so a client isn't
+// steered towards sending Basic credentials (base64, not hashed) just because
+// it asked first.
+type multiSchemeAuthHandler struct {
+	digest        *digestAuth
+	basicProvider AuthProvider
+	handler       http.HandlerFunc
+}
+
+// ServeHTTP implements http.Handler.
+func (h *multiSchemeAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var stale bool
+
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Digest ") {
+		var allowed bool
+		if allowed, stale = h.digest.verify(r); allowed {
+			h.handler(w, r)
+			return
+		}
+	} else if h.basicProvider.IsAllowed(r) {
+		h.handler(w, r)
+		return
+	}
+
+	h.digest.challenge(w, r, stale)
+	h.basicProvider.Challenge(w)
+	http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s)) //nolint:gosec
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// check interfaces
+var (
+	_ http.Handler = (*digestAuthHandler)(nil)
+	_ http.Handler = (*multiSchemeAuthHandler)(nil)
+)
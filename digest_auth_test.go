@@ -0,0 +1,184 @@
+// Copyright 2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter_shared
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHtdigestFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "htdigest")
+	contents := "# a comment\n" +
+		"\n" +
+		"alice:metrics:" + md5Hex("alice:metrics:testpass") + "\n" +
+		"bob:other-realm:" + md5Hex("bob:other-realm:testpass") + "\n" +
+		"malformed-line\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	users, err := parseHtdigestFile(path, "metrics")
+	if err != nil {
+		t.Fatalf("parseHtdigestFile: %s", err)
+	}
+
+	if len(users) != 1 {
+		t.Fatalf("got %d users for realm %q, want 1 (other realm and malformed entries excluded): %v", len(users), "metrics", users)
+	}
+	if users["alice"] != md5Hex("alice:metrics:testpass") {
+		t.Errorf("unexpected HA1 for alice: %q", users["alice"])
+	}
+}
+
+// digestClientResponse computes the RFC 2617 "response" value a conforming
+// client would send, for use as ground truth in verify() tests.
+func digestClientResponse(ha1, method, uri, nonce, nc, cnonce, qop string) string {
+	ha2 := md5Hex(method + ":" + uri)
+	return md5Hex(strings.Join([]string{ha1, nonce, nc, cnonce, qop, ha2}, ":"))
+}
+
+func newTestDigestAuth(t *testing.T, username, password, realm string) *digestAuth {
+	t.Helper()
+	ha1 := md5Hex(username + ":" + realm + ":" + password)
+	return &digestAuth{
+		realm:         realm,
+		nonceLifetime: time.Minute,
+		opaque:        "test-opaque",
+		lookupHA1: func(u string) (string, bool) {
+			if u == username {
+				return ha1, true
+			}
+			return "", false
+		},
+		nonces: make(map[string]*nonceState),
+	}
+}
+
+func TestDigestAuthRoundTrip(t *testing.T) {
+	auth := newTestDigestAuth(t, "alice", "testpass", "metrics")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	auth.challenge(rec, req, false)
+
+	nonce := extractDigestParam(t, rec.Header().Get("WWW-Authenticate"), "nonce")
+	ha1 := md5Hex("alice:metrics:testpass")
+	response := digestClientResponse(ha1, http.MethodGet, "/metrics", nonce, "00000001", "clientnonce", "auth")
+
+	authReq := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	authReq.Header.Set("Authorization", fmt.Sprintf(
+		`Digest username="alice", realm="metrics", nonce="%s", uri="/metrics", `+
+			`response="%s", qop=auth, nc=00000001, cnonce="clientnonce", opaque="test-opaque"`,
+		nonce, response,
+	))
+
+	allowed, stale := auth.verify(authReq)
+	if !allowed || stale {
+		t.Fatalf("verify() = (%v, %v), want (true, false)", allowed, stale)
+	}
+}
+
+func TestDigestAuthRejectsReplayedNC(t *testing.T) {
+	auth := newTestDigestAuth(t, "alice", "testpass", "metrics")
+
+	rec := httptest.NewRecorder()
+	auth.challenge(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil), false)
+	nonce := extractDigestParam(t, rec.Header().Get("WWW-Authenticate"), "nonce")
+
+	ha1 := md5Hex("alice:metrics:testpass")
+	response := digestClientResponse(ha1, http.MethodGet, "/metrics", nonce, "00000001", "clientnonce", "auth")
+	header := fmt.Sprintf(
+		`Digest username="alice", realm="metrics", nonce="%s", uri="/metrics", `+
+			`response="%s", qop=auth, nc=00000001, cnonce="clientnonce", opaque="test-opaque"`,
+		nonce, response,
+	)
+
+	first := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	first.Header.Set("Authorization", header)
+	if allowed, _ := auth.verify(first); !allowed {
+		t.Fatal("first use of nc should be allowed")
+	}
+
+	second := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	second.Header.Set("Authorization", header)
+	if allowed, stale := auth.verify(second); allowed || !stale {
+		t.Fatalf("replayed nc: verify() = (%v, %v), want (false, true)", allowed, stale)
+	}
+}
+
+// TestDigestAuthUnknownNonceIsStale checks that a nonce the server has never
+// seen (e.g. after a restart, or swept out as expired) still gets a
+// stale=true challenge, so a client reauthenticates silently instead of
+// re-prompting for credentials.
+func TestDigestAuthUnknownNonceIsStale(t *testing.T) {
+	auth := newTestDigestAuth(t, "alice", "testpass", "metrics")
+
+	ha1 := md5Hex("alice:metrics:testpass")
+	response := digestClientResponse(ha1, http.MethodGet, "/metrics", "never-issued-nonce", "00000001", "clientnonce", "auth")
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		`Digest username="alice", realm="metrics", nonce="never-issued-nonce", uri="/metrics", `+
+			`response="%s", qop=auth, nc=00000001, cnonce="clientnonce", opaque="test-opaque"`,
+		response,
+	))
+
+	if allowed, stale := auth.verify(req); allowed || !stale {
+		t.Fatalf("verify() for unknown nonce = (%v, %v), want (false, true)", allowed, stale)
+	}
+}
+
+func TestDigestAuthRejectsWrongPassword(t *testing.T) {
+	auth := newTestDigestAuth(t, "alice", "testpass", "metrics")
+
+	rec := httptest.NewRecorder()
+	auth.challenge(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil), false)
+	nonce := extractDigestParam(t, rec.Header().Get("WWW-Authenticate"), "nonce")
+
+	wrongHA1 := md5Hex("alice:metrics:wrongpass")
+	response := digestClientResponse(wrongHA1, http.MethodGet, "/metrics", nonce, "00000001", "clientnonce", "auth")
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		`Digest username="alice", realm="metrics", nonce="%s", uri="/metrics", `+
+			`response="%s", qop=auth, nc=00000001, cnonce="clientnonce", opaque="test-opaque"`,
+		nonce, response,
+	))
+
+	if allowed, _ := auth.verify(req); allowed {
+		t.Fatal("wrong password should not be allowed")
+	}
+}
+
+// extractDigestParam pulls a bare or quoted key=value out of a
+// WWW-Authenticate: Digest ... header, failing the test if not found.
+func extractDigestParam(t *testing.T, header, key string) string {
+	t.Helper()
+	for _, field := range strings.Split(header, ",") {
+		field = strings.TrimSpace(field)
+		if !strings.HasPrefix(field, key+"=") {
+			continue
+		}
+		return strings.Trim(strings.TrimPrefix(field, key+"="), `"`)
+	}
+	t.Fatalf("key %q not found in header %q", key, header)
+	return ""
+}
@@ -0,0 +1,275 @@
+// Copyright 2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter_shared
+
+import (
+	"bufio"
+	"crypto/md5"  //nolint:gosec
+	"crypto/sha1" //nolint:gosec
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdAuth is an AuthProvider backed by an Apache-style htpasswd file. It
+// supports bcrypt, SHA1 and apr1 (MD5) entries; plaintext and crypt(3) entries
+// are rejected at load time since they are not safe to serve over the network.
+type htpasswdAuth struct {
+	path string
+
+	mu    sync.RWMutex
+	users map[string][]byte // username -> hashed password, including its scheme prefix
+}
+
+// NewHtpasswdAuth builds an AuthProvider backed by an Apache-style htpasswd
+// file at path, loading it immediately and watching it for changes (SIGHUP
+// or mtime) afterwards.
+func NewHtpasswdAuth(path string) (AuthProvider, error) {
+	return newHtpasswdAuth(path)
+}
+
+// newHtpasswdAuth loads path and starts watching it for changes (SIGHUP or mtime).
+func newHtpasswdAuth(path string) (*htpasswdAuth, error) {
+	h := &htpasswdAuth{path: path}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	go h.watch()
+	return h, nil
+}
+
+// load (re)reads the htpasswd file and replaces the in-memory user map.
+func (h *htpasswdAuth) load() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close() //nolint:errcheck
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			log.Errorf("htpasswd file %q: skipping malformed line %q", h.path, line)
+			continue
+		}
+
+		user, hash := parts[0], parts[1]
+		if !isSupportedHtpasswdHash(hash) {
+			log.Errorf("htpasswd file %q: rejecting insecure or unsupported entry for user %q", h.path, user)
+			continue
+		}
+
+		users[user] = []byte(hash)
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.users = users
+	h.mu.Unlock()
+	return nil
+}
+
+// watch reloads the htpasswd file on SIGHUP and whenever its mtime changes.
+func (h *htpasswdAuth) watch() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	var lastMtime time.Time
+	if fi, err := os.Stat(h.path); err == nil {
+		lastMtime = fi.ModTime()
+	}
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sighup:
+			log.Infoln("Reloading htpasswd file on SIGHUP.")
+			if err := h.load(); err != nil {
+				log.Errorf("cannot reload htpasswd file %q: %s", h.path, err)
+			}
+		case <-ticker.C:
+			fi, err := os.Stat(h.path)
+			if err != nil {
+				log.Errorf("cannot stat htpasswd file %q: %s", h.path, err)
+				continue
+			}
+			if !fi.ModTime().After(lastMtime) {
+				continue
+			}
+			lastMtime = fi.ModTime()
+			log.Infoln("Reloading htpasswd file after detecting a change.")
+			if err = h.load(); err != nil {
+				log.Errorf("cannot reload htpasswd file %q: %s", h.path, err)
+			}
+		}
+	}
+}
+
+// IsAllowed implements AuthProvider.
+func (h *htpasswdAuth) IsAllowed(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	h.mu.RLock()
+	hash, found := h.users[username]
+	h.mu.RUnlock()
+	if !found {
+		return false
+	}
+
+	return verifyHtpasswdHash(string(hash), password)
+}
+
+// Challenge implements AuthProvider.
+func (h *htpasswdAuth) Challenge(w http.ResponseWriter) {
+	w.Header().Add("WWW-Authenticate", `Basic realm="metrics"`)
+}
+
+// isSupportedHtpasswdHash reports whether hash is one of the schemes we
+// support (bcrypt, SHA1, apr1). Plaintext and crypt(3) entries are rejected.
+func isSupportedHtpasswdHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2b$"):
+		return true
+	case strings.HasPrefix(hash, "{SHA}"):
+		return true
+	case strings.HasPrefix(hash, "$apr1$"):
+		return true
+	default:
+		return false
+	}
+}
+
+// verifyHtpasswdHash checks password against hash, dispatching on hash's scheme prefix.
+func verifyHtpasswdHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password)) //nolint:gosec
+		encoded := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]), []byte(encoded)) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		computed, err := apr1MD5(password, hash)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+	default:
+		return false
+	}
+}
+
+// apr1MD5 implements Apache's apr_md5_encode ($apr1$ crypt variant), reusing
+// the salt found in existingHash (either "$apr1$salt" or "$apr1$salt$hash").
+func apr1MD5(password, existingHash string) (string, error) {
+	parts := strings.Split(existingHash, "$")
+	if len(parts) < 3 || parts[1] != "apr1" {
+		return "", fmt.Errorf("not an apr1 hash: %q", existingHash)
+	}
+	salt := parts[2]
+
+	ctx := md5.New() //nolint:gosec
+	ctx.Write([]byte(password))
+	ctx.Write([]byte("$apr1$"))
+	ctx.Write([]byte(salt))
+
+	ctx1 := md5.New() //nolint:gosec
+	ctx1.Write([]byte(password))
+	ctx1.Write([]byte(salt))
+	ctx1.Write([]byte(password))
+	final := ctx1.Sum(nil)
+
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(final)
+		} else {
+			ctx.Write(final[:i])
+		}
+	}
+
+	for i := len(password); i != 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write([]byte(password[:1]))
+		}
+	}
+	final = ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		ctx2 := md5.New() //nolint:gosec
+		if i&1 != 0 {
+			ctx2.Write([]byte(password))
+		} else {
+			ctx2.Write(final)
+		}
+		if i%3 != 0 {
+			ctx2.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			ctx2.Write([]byte(password))
+		}
+		if i&1 != 0 {
+			ctx2.Write(final)
+		} else {
+			ctx2.Write([]byte(password))
+		}
+		final = ctx2.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	encode := func(v uint32, n int) string {
+		var sb strings.Builder
+		for i := 0; i < n; i++ {
+			sb.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+		return sb.String()
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encode(uint32(final[0])<<16|uint32(final[6])<<8|uint32(final[12]), 4))
+	sb.WriteString(encode(uint32(final[1])<<16|uint32(final[7])<<8|uint32(final[13]), 4))
+	sb.WriteString(encode(uint32(final[2])<<16|uint32(final[8])<<8|uint32(final[14]), 4))
+	sb.WriteString(encode(uint32(final[3])<<16|uint32(final[9])<<8|uint32(final[15]), 4))
+	sb.WriteString(encode(uint32(final[4])<<16|uint32(final[10])<<8|uint32(final[5]), 4))
+	sb.WriteString(encode(uint32(final[11]), 2))
+
+	return "$apr1$" + salt + "$" + sb.String(), nil
+}
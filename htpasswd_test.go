@@ -0,0 +1,138 @@
+// Copyright 2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter_shared
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestApr1MD5KnownVector checks apr1MD5 against `openssl passwd -apr1 -salt
+// abcdefgh testpass`, an independent implementation of the same algorithm.
+func TestApr1MD5KnownVector(t *testing.T) {
+	const want = "$apr1$abcdefgh$JDh3DOtFBWdMeBAh2S//z."
+
+	got, err := apr1MD5("testpass", "$apr1$abcdefgh$")
+	if err != nil {
+		t.Fatalf("apr1MD5: %s", err)
+	}
+	if got != want {
+		t.Fatalf("apr1MD5(%q, %q) = %q, want %q", "testpass", "$apr1$abcdefgh$", got, want)
+	}
+}
+
+func TestVerifyHtpasswdHash(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("testpass"), bcrypt.DefaultCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword: %s", err)
+	}
+
+	cases := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		{"bcrypt correct", string(bcryptHash), "testpass", true},
+		{"bcrypt wrong", string(bcryptHash), "wrongpass", false},
+		// {SHA}... vector from `python3 -c "import hashlib,base64;
+		// print(base64.b64encode(hashlib.sha1(b'testpass').digest()))"`.
+		{"sha1 correct", "{SHA}IGyAQTualsExLMNGt9JRe4RGPt0=", "testpass", true},
+		{"sha1 wrong", "{SHA}IGyAQTualsExLMNGt9JRe4RGPt0=", "wrongpass", false},
+		// apr1 vector from `openssl passwd -apr1 -salt abcdefgh testpass`.
+		{"apr1 correct", "$apr1$abcdefgh$JDh3DOtFBWdMeBAh2S//z.", "testpass", true},
+		{"apr1 wrong", "$apr1$abcdefgh$JDh3DOtFBWdMeBAh2S//z.", "wrongpass", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := verifyHtpasswdHash(c.hash, c.password); got != c.want {
+				t.Errorf("verifyHtpasswdHash(%q, %q) = %v, want %v", c.hash, c.password, got, c.want)
+			}
+		})
+	}
+}
+
+func TestIsSupportedHtpasswdHash(t *testing.T) {
+	cases := []struct {
+		hash string
+		want bool
+	}{
+		{"$2a$10$abcdefghijklmnopqrstuv", true},
+		{"$2y$10$abcdefghijklmnopqrstuv", true},
+		{"$2b$10$abcdefghijklmnopqrstuv", true},
+		{"{SHA}IGyAQTualsExLMNGt9JRe4RGPt0=", true},
+		{"$apr1$abcdefgh$JDh3DOtFBWdMeBAh2S//z.", true},
+		{"plaintextpassword", false},
+		{"qEuVQFFK6Z4FU", false}, // crypt(3) DES hash
+		{"", false},
+	}
+
+	for _, c := range cases {
+		if got := isSupportedHtpasswdHash(c.hash); got != c.want {
+			t.Errorf("isSupportedHtpasswdHash(%q) = %v, want %v", c.hash, got, c.want)
+		}
+	}
+}
+
+func TestHtpasswdAuthLoadAndIsAllowed(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "htpasswd")
+	contents := "# a comment\n" +
+		"\n" +
+		"alice:$apr1$abcdefgh$JDh3DOtFBWdMeBAh2S//z.\n" +
+		"bob:{SHA}IGyAQTualsExLMNGt9JRe4RGPt0=\n" +
+		"insecure:plaintextpassword\n" +
+		"malformed-line-without-colon\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	h := &htpasswdAuth{path: path}
+	if err := h.load(); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+
+	if len(h.users) != 2 {
+		t.Fatalf("got %d users, want 2 (insecure and malformed entries must be rejected): %v", len(h.users), h.users)
+	}
+
+	req := func(user, pass string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		r.SetBasicAuth(user, pass)
+		return r
+	}
+
+	if !h.IsAllowed(req("alice", "testpass")) {
+		t.Error("alice with correct password should be allowed")
+	}
+	if h.IsAllowed(req("alice", "wrongpass")) {
+		t.Error("alice with wrong password should not be allowed")
+	}
+	if !h.IsAllowed(req("bob", "testpass")) {
+		t.Error("bob with correct password should be allowed")
+	}
+	if h.IsAllowed(req("insecure", "plaintextpassword")) {
+		t.Error("rejected insecure entry should not be allowed even with its literal 'hash' as password")
+	}
+	if h.IsAllowed(req("nobody", "testpass")) {
+		t.Error("unknown user should not be allowed")
+	}
+}
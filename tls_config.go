@@ -0,0 +1,296 @@
+// Copyright 2017 Percona LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter_shared
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/log"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// webConfig is the YAML schema read from the file passed as tlsConfigFile to
+// RunServer, modeled after Prometheus exporter-toolkit's web config.
+type webConfig struct {
+	TLSServerConfig *tlsServerConfig  `yaml:"tls_server_config,omitempty"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users,omitempty"` // username -> bcrypt hash
+}
+
+// tlsServerConfig describes the server-side TLS/mTLS settings.
+type tlsServerConfig struct {
+	CertFile       string   `yaml:"cert_file"`
+	KeyFile        string   `yaml:"key_file"`
+	ClientCAFile   string   `yaml:"client_ca_file,omitempty"`
+	ClientAuthType string   `yaml:"client_auth_type,omitempty"`
+	MinVersion     string   `yaml:"min_version,omitempty"`
+	CipherSuites   []string `yaml:"cipher_suites,omitempty"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// loadWebConfig reads and parses path.
+func loadWebConfig(path string) (*webConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read web config file %q: %s", path, err)
+	}
+
+	var cfg webConfig
+	if err = yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse web config file %q: %s", path, err)
+	}
+	if cfg.TLSServerConfig == nil || cfg.TLSServerConfig.CertFile == "" || cfg.TLSServerConfig.KeyFile == "" {
+		return nil, fmt.Errorf("web config file %q must set tls_server_config.cert_file and key_file", path)
+	}
+	return &cfg, nil
+}
+
+// buildTLSConfig builds a *tls.Config from c, wiring up mTLS (client_ca_file,
+// client_auth_type) and hot-reloading the server certificate from disk.
+func (c *tlsServerConfig) buildTLSConfig() (*tls.Config, error) {
+	reloader, err := newCertReloader(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown min_version %q", c.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+
+	for _, name := range c.CipherSuites {
+		id, ok := cipherSuiteIDs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+
+	if c.ClientAuthType != "" {
+		clientAuthType, ok := clientAuthTypes[c.ClientAuthType]
+		if !ok {
+			return nil, fmt.Errorf("unknown client_auth_type %q", c.ClientAuthType)
+		}
+		cfg.ClientAuth = clientAuthType
+	}
+
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read client_ca_file %q: %s", c.ClientCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client_ca_file %q", c.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		if c.ClientAuthType == "" {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return cfg, nil
+}
+
+var cipherSuiteIDs = func() map[string]uint16 {
+	ids := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		ids[s.Name] = s.ID
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		ids[s.Name] = s.ID
+	}
+	return ids
+}()
+
+// certReloader serves the TLS certificate for a *tls.Config, reloading it
+// from disk whenever cert_file or key_file change.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load TLS certificate/key: %s", err)
+	}
+
+	certStat, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyStat, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.certModTime = certStat.ModTime()
+	r.keyModTime = keyStat.ModTime()
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate implements the tls.Config.GetCertificate callback.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	certModTime, keyModTime := r.certModTime, r.keyModTime
+	r.mu.RUnlock()
+
+	if certStat, err := os.Stat(r.certFile); err == nil && certStat.ModTime().After(certModTime) {
+		if err = r.reload(); err != nil {
+			log.Errorf("cannot reload TLS certificate: %s", err)
+		}
+	} else if keyStat, err := os.Stat(r.keyFile); err == nil && keyStat.ModTime().After(keyModTime) {
+		if err = r.reload(); err != nil {
+			log.Errorf("cannot reload TLS certificate: %s", err)
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// bcryptUsersAuth is an AuthProvider backed by the basic_auth_users map of a
+// web config file (username -> bcrypt hash).
+type bcryptUsersAuth struct {
+	users map[string]string
+}
+
+// IsAllowed implements AuthProvider.
+func (a *bcryptUsersAuth) IsAllowed(r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, found := a.users[username]
+	if !found {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// Challenge implements AuthProvider.
+func (a *bcryptUsersAuth) Challenge(w http.ResponseWriter) {
+	w.Header().Add("WWW-Authenticate", `Basic realm="metrics"`)
+}
+
+// RunServer starts an HTTP(S) server named name, listening on addr and
+// serving gatherer's metrics at path. If tlsConfigFile is non-empty, it is
+// parsed as a web config YAML file providing TLS/mTLS settings (it must set
+// tls_server_config.cert_file and key_file) and, optionally,
+// basic_auth_users; the server then listens with TLS and, if configured,
+// HTTP Basic authentication against the bcrypt hashes from that file. opts.Auth,
+// if set, is combined with that basic_auth_users check via ChainAuthProviders,
+// so callers can add e.g. a bearer-token or IP-allowlist provider of their own.
+func RunServer(name, addr, path string, gatherer prometheus.Gatherer, tlsConfigFile string, opts HandlerOptions) error {
+	metricsHandler := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		ErrorLog:      log.NewErrorLogger(),
+		ErrorHandling: opts.ErrorHandling,
+	})
+
+	var h http.Handler = metricsHandler
+	var tlsConfig *tls.Config
+	auth := opts.Auth
+
+	if tlsConfigFile != "" {
+		cfg, err := loadWebConfig(tlsConfigFile)
+		if err != nil {
+			return err
+		}
+
+		tlsConfig, err = cfg.TLSServerConfig.buildTLSConfig()
+		if err != nil {
+			return err
+		}
+
+		if len(cfg.BasicAuthUsers) > 0 {
+			bcryptAuth := &bcryptUsersAuth{users: cfg.BasicAuthUsers}
+			if auth != nil {
+				auth = ChainAuthProviders(auth, bcryptAuth)
+			} else {
+				auth = bcryptAuth
+			}
+			log.Infoln("HTTP Basic authentication is enabled.")
+		}
+	}
+
+	if auth != nil {
+		h = &basicAuthHandler{provider: auth, handler: metricsHandler.ServeHTTP}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, h)
+
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+
+	if tlsConfig != nil {
+		log.Infof("Starting %s with TLS at %s%s", name, addr, path)
+		return server.ListenAndServeTLS("", "")
+	}
+
+	log.Infof("Starting %s at %s%s", name, addr, path)
+	return server.ListenAndServe()
+}